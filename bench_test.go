@@ -0,0 +1,38 @@
+package storable
+
+import "testing"
+
+type benchLevel struct {
+  Name  string
+  Count int
+  Next  *benchLevel
+}
+
+func buildBenchLevels(depth int) *benchLevel {
+  var head *benchLevel
+  for i := 0; i < depth; i++ {
+    head = &benchLevel{Name: "level", Count: i, Next: head}
+  }
+
+  return head
+}
+
+// BenchmarkMarshalNestedStruct exercises marshalStruct's hot path: a
+// struct nested many levels deep. Before the lazy-encoder rewrite,
+// marshalStruct allocated a fresh bytes.Buffer-backed encodeState per
+// level just to count children before writing the SX_HASH length
+// prefix, so allocations grew with depth * the buffer's default
+// capacity. The encoder tree in lazy.go replaces that with one small
+// node per field and a single final []byte sized by Len().
+func BenchmarkMarshalNestedStruct(b *testing.B) {
+  v := buildBenchLevels(20)
+
+  b.ReportAllocs()
+  b.ResetTimer()
+
+  for i := 0; i < b.N; i++ {
+    if _, err := Marshal(v); err != nil {
+      b.Fatal(err)
+    }
+  }
+}
@@ -0,0 +1,627 @@
+package storable
+
+import (
+  "bytes"
+  "encoding/binary"
+  "fmt"
+  "io"
+  "reflect"
+  "strconv"
+)
+
+// An UnmarshalTypeError describes a value in the Storable stream that
+// was not appropriate for the Go value it was decoded into.
+type UnmarshalTypeError struct {
+  Tag   byte
+  Value reflect.Type
+}
+
+func (e *UnmarshalTypeError) Error() string {
+  return fmt.Sprintf("storable: cannot unmarshal tag 0x%x into Go value of type %s", e.Tag, e.Value)
+}
+
+// Unmarshaler is implemented by types that want to decode themselves
+// from a Storable scalar, analogous to encoding.BinaryUnmarshaler.
+type Unmarshaler interface {
+  UnmarshalStorable([]byte) error
+}
+
+var unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+
+// A Decoder reads and decodes Storable values from an input stream.
+type Decoder struct {
+  d decodeState
+}
+
+// NewDecoder returns a new Decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+  return &Decoder{d: decodeState{r: r}}
+}
+
+// Decode reads the next Storable-encoded value from its input and
+// stores it in the value pointed to by v.
+func (dec *Decoder) Decode(v interface{}) error {
+  return dec.d.unmarshal(v)
+}
+
+// Unmarshal parses the Storable-encoded data and stores the result in
+// the value pointed to by v.
+func Unmarshal(data []byte, v interface{}) error {
+  d := decodeState{r: bytes.NewReader(data)}
+  return d.unmarshal(v)
+}
+
+// A decodeState reads storable data from an io.Reader.
+type decodeState struct {
+  r io.Reader
+
+  networkOrder bool
+  seen         []reflect.Value // object index -> decoded value, for SX_OBJECT backrefs
+  classes      []string        // class index -> class name, for SX_IX_BLESS
+}
+
+func (d *decodeState) unmarshal(v interface{}) error {
+  rv := reflect.ValueOf(v)
+  if rv.Kind() != reflect.Ptr || rv.IsNil() {
+    return fmt.Errorf("storable: Decode(non-pointer %s)", reflect.TypeOf(v))
+  }
+
+  hdrBytes := make([]byte, 2)
+  if _, err := io.ReadFull(d.r, hdrBytes); err != nil {
+    return err
+  }
+
+  magic, version := hdrBytes[0], hdrBytes[1]
+  if magic != MAGIC {
+    return fmt.Errorf("storable: bad magic byte 0x%x", magic)
+  }
+  d.networkOrder = version&networkOrderFlag != 0
+  d.seen = nil
+  d.classes = nil
+
+  return d.unmarshalValue(rv.Elem())
+}
+
+func (d *decodeState) readTag() (byte, error) {
+  var tag uint8
+  err := binary.Read(d.r, binary.BigEndian, &tag)
+  return tag, err
+}
+
+func (d *decodeState) readUint32() (uint32, error) {
+  var n uint32
+  err := binary.Read(d.r, binary.BigEndian, &n)
+  return n, err
+}
+
+func (d *decodeState) readString(n int) (string, error) {
+  buf := make([]byte, n)
+  if _, err := io.ReadFull(d.r, buf); err != nil {
+    return "", err
+  }
+  return string(buf), nil
+}
+
+// readScalarBytes reads the length/data payload that follows a
+// SX_SCALAR/SX_LSCALAR/SX_UTF8STR/SX_LUTF8STR tag.
+func (d *decodeState) readScalarBytes(tag byte) ([]byte, error) {
+  var n int
+  if tag == SX_LSCALAR || tag == SX_LUTF8STR {
+    ln, err := d.readUint32()
+    if err != nil {
+      return nil, err
+    }
+    n = int(ln)
+  } else {
+    var l uint8
+    if err := binary.Read(d.r, binary.BigEndian, &l); err != nil {
+      return nil, err
+    }
+    n = int(l)
+  }
+
+  buf := make([]byte, n)
+  if _, err := io.ReadFull(d.r, buf); err != nil {
+    return nil, err
+  }
+  return buf, nil
+}
+
+// readInteger reads the payload that follows a SX_INTEGER (8 bytes,
+// little-endian) or SX_NETINT (network order, 32-bit) tag.
+func (d *decodeState) readInteger(tag byte) (int64, error) {
+  if tag == SX_NETINT {
+    var n int32
+    if err := binary.Read(d.r, binary.BigEndian, &n); err != nil {
+      return 0, err
+    }
+    return int64(n), nil
+  }
+
+  var n int64
+  if err := binary.Read(d.r, binary.LittleEndian, &n); err != nil {
+    return 0, err
+  }
+  return n, nil
+}
+
+// readByte reads the single-byte payload that follows a SX_BYTE tag:
+// a small signed integer biased by 128 so it fits in an unsigned
+// byte. This package never writes SX_BYTE itself, but Perl's
+// Storable does for small integers.
+func (d *decodeState) readByte() (int64, error) {
+  var n uint8
+  if err := binary.Read(d.r, binary.BigEndian, &n); err != nil {
+    return 0, err
+  }
+  return int64(n) - 128, nil
+}
+
+// readDouble reads the 8-byte little-endian IEEE-754 payload that
+// follows a SX_DOUBLE tag.
+func (d *decodeState) readDouble() (float64, error) {
+  var f float64
+  if err := binary.Read(d.r, binary.LittleEndian, &f); err != nil {
+    return 0, err
+  }
+  return f, nil
+}
+
+// unmarshalValue reads a single tagged Storable value and stores it
+// into value, which must be settable (or the blank interface{}
+// target used by the generic decode path).
+func (d *decodeState) unmarshalValue(value reflect.Value) error {
+  if value.IsValid() && value.CanAddr() {
+    if value.Addr().Type().Implements(unmarshalerType) {
+      return d.unmarshalUnmarshaler(value.Addr().Interface().(Unmarshaler))
+    }
+  }
+
+  tag, err := d.readTag()
+  if err != nil {
+    return err
+  }
+
+  switch tag {
+  case SX_UNDEF:
+    return assign(value, nil)
+  case SX_REF:
+    return d.unmarshalRef(value)
+  case SX_OBJECT:
+    return d.unmarshalObject(value)
+  case SX_HASH:
+    return d.unmarshalHash(value)
+  case SX_ARRAY:
+    return d.unmarshalArray(value)
+  case SX_SCALAR, SX_LSCALAR, SX_UTF8STR, SX_LUTF8STR:
+    b, err := d.readScalarBytes(tag)
+    if err != nil {
+      return err
+    }
+    return assign(value, string(b))
+  case SX_INTEGER, SX_NETINT:
+    n, err := d.readInteger(tag)
+    if err != nil {
+      return err
+    }
+    return assign(value, n)
+  case SX_BYTE:
+    n, err := d.readByte()
+    if err != nil {
+      return err
+    }
+    return assign(value, n)
+  case SX_DOUBLE:
+    f, err := d.readDouble()
+    if err != nil {
+      return err
+    }
+    return assign(value, f)
+  case SX_BLESS, SX_IX_BLESS:
+    return d.unmarshalBlessed(value, tag)
+  }
+
+  return fmt.Errorf("storable: unknown tag 0x%x", tag)
+}
+
+func (d *decodeState) unmarshalUnmarshaler(u Unmarshaler) error {
+  tag, err := d.readTag()
+  if err != nil {
+    return err
+  }
+
+  switch tag {
+  case SX_UNDEF:
+    return nil
+  case SX_SCALAR, SX_LSCALAR, SX_UTF8STR, SX_LUTF8STR:
+    b, err := d.readScalarBytes(tag)
+    if err != nil {
+      return err
+    }
+    return u.UnmarshalStorable(b)
+  }
+
+  return fmt.Errorf("storable: cannot unmarshal tag 0x%x into %T", tag, u)
+}
+
+// unmarshalRef decodes the value a SX_REF points to, registering it
+// in the backreference table so a later SX_OBJECT can resolve to it.
+func (d *decodeState) unmarshalRef(value reflect.Value) error {
+  if value.Kind() == reflect.Ptr {
+    if value.IsNil() {
+      value.Set(reflect.New(value.Type().Elem()))
+    }
+    d.seen = append(d.seen, value)
+    return d.unmarshalValue(value.Elem())
+  }
+
+  // The destination isn't a pointer (e.g. a nested struct field
+  // that was a ref on the Perl side, or a non-pointer top-level
+  // target). Register its address, if it has one, so a
+  // backreference elsewhere in the graph that does expect a
+  // pointer can still resolve to it; register it before decoding so
+  // a self-referential cycle can see it.
+  var seen reflect.Value
+  if value.CanAddr() {
+    seen = value.Addr()
+  }
+  d.seen = append(d.seen, seen)
+
+  return d.unmarshalValue(value)
+}
+
+// unmarshalObject resolves a SX_OBJECT backreference against the
+// table built up by unmarshalRef.
+func (d *decodeState) unmarshalObject(value reflect.Value) error {
+  idx, err := d.readUint32()
+  if err != nil {
+    return err
+  }
+  if int(idx) >= len(d.seen) {
+    return fmt.Errorf("storable: invalid object backreference %d", idx)
+  }
+  seen := d.seen[idx]
+  if !seen.IsValid() {
+    return nil
+  }
+
+  switch value.Kind() {
+  case reflect.Ptr:
+    if seen.Kind() == reflect.Ptr && seen.Type() == value.Type() {
+      value.Set(seen)
+    }
+  case reflect.Interface:
+    value.Set(seen)
+  }
+
+  return nil
+}
+
+// retarget patches backreference table entries created while from
+// was decoded generically into tmp (a struct field or map element
+// decoded before its key was known, see unmarshalHash) so a later
+// SX_OBJECT resolves to the field's real, typed destination (dst)
+// instead of the throwaway interface{} that the generic decode had
+// to register with instead.
+func (d *decodeState) retarget(from int, tmp *interface{}, dst reflect.Value) {
+  tmpAddr := reflect.ValueOf(tmp).Pointer()
+  for i := from; i < len(d.seen); i++ {
+    seen := d.seen[i]
+    if seen.IsValid() && seen.Kind() == reflect.Ptr && seen.Pointer() == tmpAddr {
+      d.seen[i] = dst
+    }
+  }
+}
+
+func (d *decodeState) unmarshalBlessed(value reflect.Value, tag byte) error {
+  if tag == SX_BLESS {
+    n, err := d.readUint32()
+    if err != nil {
+      return err
+    }
+    class, err := d.readString(int(n))
+    if err != nil {
+      return err
+    }
+    d.classes = append(d.classes, class)
+  } else {
+    idx, err := d.readUint32()
+    if err != nil {
+      return err
+    }
+    if int(idx) >= len(d.classes) {
+      return fmt.Errorf("storable: invalid bless class backreference %d", idx)
+    }
+  }
+
+  // Go values have no notion of a Perl class; decode the underlying
+  // value and drop the class name on the floor.
+  return d.unmarshalValue(value)
+}
+
+func (d *decodeState) unmarshalHash(value reflect.Value) error {
+  n, err := d.readUint32()
+  if err != nil {
+    return err
+  }
+
+  switch value.Kind() {
+  case reflect.Struct:
+    fields := make(map[string]reflect.Value)
+    typ := value.Type()
+    for i := 0; i < typ.NumField(); i++ {
+      f := typ.Field(i)
+      name, _, skip := fieldTag(f)
+      if skip {
+        continue
+      }
+      fields[name] = value.Field(i)
+    }
+
+    for i := uint32(0); i < n; i++ {
+      seenStart := len(d.seen)
+      var tmp interface{}
+      if err := d.unmarshalValue(reflect.ValueOf(&tmp).Elem()); err != nil {
+        return err
+      }
+
+      keyLen, err := d.readUint32()
+      if err != nil {
+        return err
+      }
+      key, err := d.readString(int(keyLen))
+      if err != nil {
+        return err
+      }
+
+      if fv, ok := fields[key]; ok {
+        if err := assign(fv, tmp); err != nil {
+          return err
+        }
+        d.retarget(seenStart, &tmp, fv)
+      }
+    }
+
+    return nil
+
+  case reflect.Map:
+    if value.IsNil() {
+      value.Set(reflect.MakeMap(value.Type()))
+    }
+    elemType := value.Type().Elem()
+
+    for i := uint32(0); i < n; i++ {
+      seenStart := len(d.seen)
+      var tmp interface{}
+      if err := d.unmarshalValue(reflect.ValueOf(&tmp).Elem()); err != nil {
+        return err
+      }
+
+      keyLen, err := d.readUint32()
+      if err != nil {
+        return err
+      }
+      key, err := d.readString(int(keyLen))
+      if err != nil {
+        return err
+      }
+
+      elem := reflect.New(elemType).Elem()
+      if err := assign(elem, tmp); err != nil {
+        return err
+      }
+      d.retarget(seenStart, &tmp, elem)
+      value.SetMapIndex(reflect.ValueOf(key), elem)
+    }
+
+    return nil
+
+  case reflect.Interface:
+    m := make(map[string]interface{}, n)
+    for i := uint32(0); i < n; i++ {
+      seenStart := len(d.seen)
+      var tmp interface{}
+      if err := d.unmarshalValue(reflect.ValueOf(&tmp).Elem()); err != nil {
+        return err
+      }
+
+      keyLen, err := d.readUint32()
+      if err != nil {
+        return err
+      }
+      key, err := d.readString(int(keyLen))
+      if err != nil {
+        return err
+      }
+
+      m[key] = tmp
+      d.retarget(seenStart, &tmp, reflect.ValueOf(tmp))
+    }
+    value.Set(reflect.ValueOf(m))
+
+    return nil
+  }
+
+  return &UnmarshalTypeError{Tag: SX_HASH, Value: value.Type()}
+}
+
+func (d *decodeState) unmarshalArray(value reflect.Value) error {
+  n, err := d.readUint32()
+  if err != nil {
+    return err
+  }
+
+  switch value.Kind() {
+  case reflect.Slice:
+    value.Set(reflect.MakeSlice(value.Type(), int(n), int(n)))
+    for i := uint32(0); i < n; i++ {
+      if err := d.unmarshalValue(value.Index(int(i))); err != nil {
+        return err
+      }
+    }
+
+    return nil
+
+  case reflect.Array:
+    for i := uint32(0); i < n; i++ {
+      if int(i) >= value.Len() {
+        var discard interface{}
+        if err := d.unmarshalValue(reflect.ValueOf(&discard).Elem()); err != nil {
+          return err
+        }
+        continue
+      }
+      if err := d.unmarshalValue(value.Index(int(i))); err != nil {
+        return err
+      }
+    }
+
+    return nil
+
+  case reflect.Interface:
+    s := make([]interface{}, n)
+    for i := uint32(0); i < n; i++ {
+      if err := d.unmarshalValue(reflect.ValueOf(&s[i]).Elem()); err != nil {
+        return err
+      }
+    }
+    value.Set(reflect.ValueOf(s))
+
+    return nil
+  }
+
+  return &UnmarshalTypeError{Tag: SX_ARRAY, Value: value.Type()}
+}
+
+// assign converts the generically decoded value src (nil, string,
+// int64, float64, []interface{}, or map[string]interface{}) into
+// dst.
+func assign(dst reflect.Value, src interface{}) error {
+  if src == nil {
+    dst.Set(reflect.Zero(dst.Type()))
+    return nil
+  }
+
+  // A resolved SX_OBJECT backreference hands back the already-typed
+  // Go value (e.g. a *node); pass it through directly if it fits,
+  // rather than falling into the Ptr case below and allocating a
+  // fresh, disconnected value.
+  if rv := reflect.ValueOf(src); rv.Type().AssignableTo(dst.Type()) {
+    dst.Set(rv)
+    return nil
+  }
+
+  if dst.Kind() == reflect.Ptr {
+    if dst.IsNil() {
+      dst.Set(reflect.New(dst.Type().Elem()))
+    }
+    return assign(dst.Elem(), src)
+  }
+
+  if dst.Kind() == reflect.Interface {
+    dst.Set(reflect.ValueOf(src))
+    return nil
+  }
+
+  switch v := src.(type) {
+  case string:
+    switch dst.Kind() {
+    case reflect.String:
+      dst.SetString(v)
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+      n, err := strconv.ParseInt(v, 10, 64)
+      if err != nil {
+        return err
+      }
+      dst.SetInt(n)
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+      n, err := strconv.ParseUint(v, 10, 64)
+      if err != nil {
+        return err
+      }
+      dst.SetUint(n)
+    case reflect.Float32, reflect.Float64:
+      n, err := strconv.ParseFloat(v, dst.Type().Bits())
+      if err != nil {
+        return err
+      }
+      dst.SetFloat(n)
+    case reflect.Bool:
+      dst.SetBool(v == "1")
+    default:
+      return &UnmarshalTypeError{Tag: SX_SCALAR, Value: dst.Type()}
+    }
+
+  case int64:
+    switch dst.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+      dst.SetInt(v)
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+      dst.SetUint(uint64(v))
+    case reflect.Float32, reflect.Float64:
+      dst.SetFloat(float64(v))
+    case reflect.Bool:
+      dst.SetBool(v != 0)
+    default:
+      return &UnmarshalTypeError{Tag: SX_INTEGER, Value: dst.Type()}
+    }
+
+  case float64:
+    switch dst.Kind() {
+    case reflect.Float32, reflect.Float64:
+      dst.SetFloat(v)
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+      dst.SetInt(int64(v))
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+      dst.SetUint(uint64(v))
+    default:
+      return &UnmarshalTypeError{Tag: SX_DOUBLE, Value: dst.Type()}
+    }
+
+  case map[string]interface{}:
+    switch dst.Kind() {
+    case reflect.Struct:
+      typ := dst.Type()
+      for i := 0; i < typ.NumField(); i++ {
+        f := typ.Field(i)
+        name, _, skip := fieldTag(f)
+        if skip {
+          continue
+        }
+        if fv, ok := v[name]; ok {
+          if err := assign(dst.Field(i), fv); err != nil {
+            return err
+          }
+        }
+      }
+    case reflect.Map:
+      if dst.IsNil() {
+        dst.Set(reflect.MakeMap(dst.Type()))
+      }
+      for key, val := range v {
+        elem := reflect.New(dst.Type().Elem()).Elem()
+        if err := assign(elem, val); err != nil {
+          return err
+        }
+        dst.SetMapIndex(reflect.ValueOf(key), elem)
+      }
+    default:
+      return &UnmarshalTypeError{Tag: SX_HASH, Value: dst.Type()}
+    }
+
+  case []interface{}:
+    switch dst.Kind() {
+    case reflect.Slice:
+      dst.Set(reflect.MakeSlice(dst.Type(), len(v), len(v)))
+      for i, e := range v {
+        if err := assign(dst.Index(i), e); err != nil {
+          return err
+        }
+      }
+    default:
+      return &UnmarshalTypeError{Tag: SX_ARRAY, Value: dst.Type()}
+    }
+  }
+
+  return nil
+}
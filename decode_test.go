@@ -0,0 +1,331 @@
+package storable
+
+import (
+  "bytes"
+  "reflect"
+  "strings"
+  "testing"
+)
+
+type UnmarshalTest struct {
+  in  interface{}
+  out interface{}
+}
+
+var (
+  unmarshalTests = []UnmarshalTest{
+    {struct{ Name string }{"Kevin"}, &struct{ Name string }{}},
+
+    {struct {
+      Name string
+      Omit string `storable:"omitempty"`
+    }{Name: "Kevin"}, &struct {
+      Name string
+      Omit string `storable:"omitempty"`
+    }{}},
+
+    {struct {
+      Nested *nested `storable:"nested"`
+    }{&nested{"Kevin"}}, &struct {
+      Nested *nested `storable:"nested"`
+    }{}},
+
+    {"Kevin", new(string)},
+    {1234, new(int)},
+    {5.55, new(float64)},
+    {false, new(bool)},
+    {[]string{"hey", "there"}, &[]string{}},
+  }
+)
+
+func TestUnmarshal(t *testing.T) {
+  for i, tt := range unmarshalTests {
+    b, err := Marshal(tt.in)
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    if err := Unmarshal(b, tt.out); err != nil {
+      t.Fatalf("%d. Unmarshal(%#v) error: %v", i, tt.in, err)
+    }
+
+    got := reflect.ValueOf(tt.out).Elem().Interface()
+    if !reflect.DeepEqual(got, tt.in) {
+      t.Fatalf("%d. Unmarshal(Marshal(%#v)) = %#v, want %#v", i, tt.in, got, tt.in)
+    }
+  }
+}
+
+func TestDecoderRenameAndSkip(t *testing.T) {
+  type in struct {
+    Name   string
+    Secret string `storable:"-"`
+  }
+  type out struct {
+    Renamed string `storable:"Name"`
+    Secret  string `storable:"-"`
+  }
+
+  b, err := Marshal(in{Name: "Kevin", Secret: "hunter2"})
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  var o out
+  if err := Unmarshal(b, &o); err != nil {
+    t.Fatal(err)
+  }
+
+  if o.Renamed != "Kevin" {
+    t.Fatalf("Renamed = %q, want %q", o.Renamed, "Kevin")
+  }
+  if o.Secret != "" {
+    t.Fatalf("Secret = %q, want empty (skipped field)", o.Secret)
+  }
+}
+
+func TestLargeString(t *testing.T) {
+  in := struct{ Name string }{strings.Repeat("x", 300)}
+
+  b, err := Marshal(in)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  var out struct{ Name string }
+  if err := Unmarshal(b, &out); err != nil {
+    t.Fatal(err)
+  }
+
+  if out.Name != in.Name {
+    t.Fatalf("Name has length %d, want %d", len(out.Name), len(in.Name))
+  }
+}
+
+func TestNetworkOrder(t *testing.T) {
+  var buf bytes.Buffer
+  enc := NewEncoder(&buf)
+  enc.NetworkOrder = true
+
+  in := struct{ Count int }{Count: 1234}
+  if err := enc.Encode(in); err != nil {
+    t.Fatal(err)
+  }
+
+  var out struct{ Count int }
+  if err := NewDecoder(&buf).Decode(&out); err != nil {
+    t.Fatal(err)
+  }
+
+  if out.Count != in.Count {
+    t.Fatalf("Count = %d, want %d", out.Count, in.Count)
+  }
+}
+
+func TestUnexportedField(t *testing.T) {
+  type t2 struct {
+    Name   string
+    secret string
+  }
+
+  in := t2{Name: "Kevin", secret: "hunter2"}
+
+  b, err := Marshal(in)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  var out t2
+  if err := Unmarshal(b, &out); err != nil {
+    t.Fatal(err)
+  }
+
+  if out.Name != "Kevin" {
+    t.Fatalf("Name = %q, want %q", out.Name, "Kevin")
+  }
+  if out.secret != "" {
+    t.Fatalf("secret = %q, want empty (unexported fields are never decoded into)", out.secret)
+  }
+}
+
+func TestByteTag(t *testing.T) {
+  // Perl's Storable commonly writes small integers as SX_BYTE (a
+  // single byte biased by 128) rather than SX_INTEGER/SX_NETINT; this
+  // package never emits it, but must still be able to read it back.
+  var buf bytes.Buffer
+  buf.WriteByte(MAGIC)
+  buf.WriteByte(VERSION)
+  buf.WriteByte(SX_BYTE)
+  buf.WriteByte(128 + 30)
+
+  var out int
+  if err := Unmarshal(buf.Bytes(), &out); err != nil {
+    t.Fatal(err)
+  }
+  if out != 30 {
+    t.Fatalf("out = %d, want 30", out)
+  }
+}
+
+func TestNetworkOrderOverflow(t *testing.T) {
+  var buf bytes.Buffer
+  enc := NewEncoder(&buf)
+  enc.NetworkOrder = true
+
+  in := struct{ Count int64 }{Count: 5000000000}
+  if err := enc.Encode(in); err == nil {
+    t.Fatalf("Encode(%#v) with NetworkOrder = nil error, want overflow error", in)
+  }
+}
+
+func TestCyclicPointer(t *testing.T) {
+  type node struct {
+    Name string
+    Next *node
+  }
+
+  a := &node{Name: "a"}
+  a.Next = a
+
+  b, err := Marshal(a)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  var out node
+  if err := Unmarshal(b, &out); err != nil {
+    t.Fatal(err)
+  }
+
+  if out.Name != "a" {
+    t.Fatalf("Name = %q, want %q", out.Name, "a")
+  }
+  if out.Next != &out {
+    t.Fatalf("Next does not point back to the decoded value")
+  }
+}
+
+func TestSharedPointerField(t *testing.T) {
+  type node struct {
+    Name string
+  }
+  type pair struct {
+    A *node
+    B *node
+  }
+
+  n := &node{Name: "shared"}
+  in := pair{A: n, B: n}
+
+  b, err := Marshal(in)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  var out pair
+  if err := Unmarshal(b, &out); err != nil {
+    t.Fatal(err)
+  }
+
+  if out.A == nil || out.B == nil {
+    t.Fatalf("A = %v, B = %v, want both non-nil", out.A, out.B)
+  }
+  if out.A != out.B {
+    t.Fatalf("A and B decoded to distinct pointers, want a shared pointer")
+  }
+  if out.B.Name != "shared" {
+    t.Fatalf("B.Name = %q, want %q", out.B.Name, "shared")
+  }
+}
+
+func TestSharedPointerFieldIntoInterface(t *testing.T) {
+  type node struct {
+    Name string
+  }
+  type pair struct {
+    A *node
+    B *node
+  }
+
+  n := &node{Name: "shared"}
+  in := pair{A: n, B: n}
+
+  b, err := Marshal(in)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  var out interface{}
+  if err := Unmarshal(b, &out); err != nil {
+    t.Fatal(err)
+  }
+
+  m, ok := out.(map[string]interface{})
+  if !ok {
+    t.Fatalf("out is %T, want map[string]interface{}", out)
+  }
+
+  if _, ok := m["A"].(map[string]interface{}); !ok {
+    t.Fatalf("A is %T, want map[string]interface{}", m["A"])
+  }
+  b2, ok := m["B"].(map[string]interface{})
+  if !ok {
+    t.Fatalf("B is %T, want map[string]interface{}", m["B"])
+  }
+  if b2["Name"] != "shared" {
+    t.Fatalf("B[\"Name\"] = %v, want %q", b2["Name"], "shared")
+  }
+}
+
+type blessedThing struct {
+  Name string
+}
+
+func (b blessedThing) StorableBless() string { return "My::Thing" }
+
+func TestBlesser(t *testing.T) {
+  in := blessedThing{Name: "Kevin"}
+
+  b, err := Marshal(in)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  var out blessedThing
+  if err := Unmarshal(b, &out); err != nil {
+    t.Fatal(err)
+  }
+
+  if out.Name != "Kevin" {
+    t.Fatalf("Name = %q, want %q", out.Name, "Kevin")
+  }
+}
+
+type upperCaser string
+
+func (u upperCaser) MarshalStorable() ([]byte, error) {
+  return []byte(strings.ToUpper(string(u))), nil
+}
+
+func (u *upperCaser) UnmarshalStorable(b []byte) error {
+  *u = upperCaser(b)
+  return nil
+}
+
+func TestMarshalerUnmarshaler(t *testing.T) {
+  in := upperCaser("kevin")
+
+  b, err := Marshal(in)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  var out upperCaser
+  if err := Unmarshal(b, &out); err != nil {
+    t.Fatal(err)
+  }
+
+  if out != "KEVIN" {
+    t.Fatalf("out = %q, want %q", out, "KEVIN")
+  }
+}
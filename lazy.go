@@ -0,0 +1,101 @@
+package storable
+
+import "encoding/binary"
+
+// An encoder is a node in a lazily-built encoding tree: it reports its
+// encoded length before any bytes are written, so marshal can size a
+// single buffer and fill it in one pass instead of accumulating
+// through nested temporary encodeState buffers (previously one per
+// struct level, see marshalStruct's history). Modeled on the encoder
+// tree encoding/asn1's Marshal builds internally.
+type encoder interface {
+  Len() int
+  Encode(dst []byte) int // writes into dst[:Len()], returns the count written
+}
+
+// byteEncoder encodes a single byte, typically an SX_* tag.
+type byteEncoder byte
+
+func (c byteEncoder) Len() int { return 1 }
+
+func (c byteEncoder) Encode(dst []byte) int {
+  dst[0] = byte(c)
+  return 1
+}
+
+// bytesEncoder copies b verbatim.
+type bytesEncoder []byte
+
+func (b bytesEncoder) Len() int { return len(b) }
+
+func (b bytesEncoder) Encode(dst []byte) int { return copy(dst, b) }
+
+// stringEncoder copies s verbatim, without the []byte(s) conversion a
+// bytesEncoder would need.
+type stringEncoder string
+
+func (s stringEncoder) Len() int { return len(s) }
+
+func (s stringEncoder) Encode(dst []byte) int { return copy(dst, s) }
+
+// uintEncoder encodes n as a fixed-width integer in the given byte
+// order. width must be 1, 4, or 8.
+type uintEncoder struct {
+  n     uint64
+  width int
+  order binary.ByteOrder
+}
+
+func (u uintEncoder) Len() int { return u.width }
+
+func (u uintEncoder) Encode(dst []byte) int {
+  switch u.width {
+  case 1:
+    dst[0] = byte(u.n)
+  case 4:
+    u.order.PutUint32(dst, uint32(u.n))
+  case 8:
+    u.order.PutUint64(dst, u.n)
+  }
+
+  return u.width
+}
+
+// multiEncoder concatenates a fixed sequence of child encoders.
+type multiEncoder []encoder
+
+func (m multiEncoder) Len() int {
+  n := 0
+  for _, c := range m {
+    n += c.Len()
+  }
+
+  return n
+}
+
+func (m multiEncoder) Encode(dst []byte) int {
+  off := 0
+  for _, c := range m {
+    off += c.Encode(dst[off:])
+  }
+
+  return off
+}
+
+// taggedEncoder encodes <tag> <4:count, big-endian> <body>, the shape
+// shared by SX_HASH and SX_ARRAY. count is the entry/element count,
+// tracked separately from body.Len() since it's measured in items
+// rather than bytes.
+type taggedEncoder struct {
+  tag   byte
+  count uint32
+  body  encoder
+}
+
+func (t *taggedEncoder) Len() int { return 1 + 4 + t.body.Len() }
+
+func (t *taggedEncoder) Encode(dst []byte) int {
+  dst[0] = t.tag
+  binary.BigEndian.PutUint32(dst[1:5], t.count)
+  return 5 + t.body.Encode(dst[5:])
+}
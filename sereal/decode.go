@@ -0,0 +1,534 @@
+package sereal
+
+import (
+  "bufio"
+  "bytes"
+  "compress/zlib"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "reflect"
+  "strconv"
+)
+
+// Unmarshaler is implemented by types that want to decode themselves
+// from a Sereal scalar, analogous to encoding.BinaryUnmarshaler.
+type Unmarshaler interface {
+  UnmarshalSereal([]byte) error
+}
+
+var unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+
+// UnmarshalTypeError describes a value in the Sereal stream that was
+// not appropriate for the Go value it was decoded into.
+type UnmarshalTypeError struct {
+  Tag   byte
+  Value reflect.Type
+}
+
+func (e *UnmarshalTypeError) Error() string {
+  return fmt.Sprintf("sereal: cannot unmarshal tag 0x%x into Go value of type %s", e.Tag, e.Value)
+}
+
+// Decoder reads and decodes Sereal values from an input stream.
+type Decoder struct {
+  r io.Reader
+}
+
+// NewDecoder returns a new Decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+  return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Decode reads the next Sereal-encoded document from its input and
+// stores the result in the value pointed to by v.
+func (dec *Decoder) Decode(v interface{}) error {
+  return unmarshal(dec.r, v)
+}
+
+// Unmarshal parses Sereal-encoded data and stores the result in the
+// value pointed to by v.
+func Unmarshal(data []byte, v interface{}) error {
+  return unmarshal(bytes.NewReader(data), v)
+}
+
+func unmarshal(r io.Reader, v interface{}) error {
+  rv := reflect.ValueOf(v)
+  if rv.Kind() != reflect.Ptr || rv.IsNil() {
+    return fmt.Errorf("sereal: Decode(non-pointer %s)", reflect.TypeOf(v))
+  }
+
+  var got [4]byte
+  if _, err := io.ReadFull(r, got[:]); err != nil {
+    return err
+  }
+  if got != magic {
+    return fmt.Errorf("sereal: bad magic bytes %x", got)
+  }
+
+  // Reuse a buffered reader handed in by a Decoder so bytes read past
+  // this document stay available to the next Decode call.
+  br, ok := r.(*bufio.Reader)
+  if !ok {
+    br = bufio.NewReader(r)
+  }
+  versionType, err := br.ReadByte()
+  if err != nil {
+    return err
+  }
+  encoding := versionType >> 4
+
+  suffixLen, err := readVarint(br)
+  if err != nil {
+    return err
+  }
+  if _, err := io.CopyN(ioutil.Discard, br, int64(suffixLen)); err != nil {
+    return err
+  }
+
+  bodyLen, err := readVarint(br)
+  if err != nil {
+    return err
+  }
+
+  body := make([]byte, bodyLen)
+  if _, err := io.ReadFull(br, body); err != nil {
+    return err
+  }
+
+  if encoding == encodingZlib {
+    zr, err := zlib.NewReader(bytes.NewReader(body))
+    if err != nil {
+      return err
+    }
+    defer zr.Close()
+    body, err = ioutil.ReadAll(zr)
+    if err != nil {
+      return err
+    }
+  }
+
+  d := &decodeState{r: bufio.NewReader(bytes.NewReader(body)), tracked: make(map[int]reflect.Value)}
+
+  return d.unmarshalValue(rv.Elem())
+}
+
+type decodeState struct {
+  r       *bufio.Reader
+  offset  int
+  tracked map[int]reflect.Value // byte offset -> decoded value, for REFP backrefs
+}
+
+func (d *decodeState) readByte() (byte, error) {
+  b, err := d.r.ReadByte()
+  if err == nil {
+    d.offset++
+  }
+  return b, err
+}
+
+func (d *decodeState) readBytes(n int) ([]byte, error) {
+  buf := make([]byte, n)
+  if _, err := io.ReadFull(d.r, buf); err != nil {
+    return nil, err
+  }
+  d.offset += n
+  return buf, nil
+}
+
+func (d *decodeState) readVarint() (uint64, error) {
+  n, err := readVarint(countingByteReader{d})
+  return n, err
+}
+
+// countingByteReader adapts decodeState's offset tracking to the
+// io.ByteReader interface expected by readVarint.
+type countingByteReader struct {
+  d *decodeState
+}
+
+func (c countingByteReader) ReadByte() (byte, error) {
+  return c.d.readByte()
+}
+
+func (d *decodeState) unmarshalValue(value reflect.Value) error {
+  if value.IsValid() && value.CanAddr() {
+    if value.Addr().Type().Implements(unmarshalerType) {
+      return d.unmarshalUnmarshaler(value.Addr().Interface().(Unmarshaler))
+    }
+  }
+
+  tag, err := d.readByte()
+  if err != nil {
+    return err
+  }
+
+  switch {
+  case tag <= tagNEG16-1: // POS0..POS15
+    return assign(value, int64(tag))
+  case tag >= tagNEG16 && tag < tagVARINT:
+    return assign(value, int64(tag)-int64(tagNEG16)-16)
+  case tag >= tagSHORT_BINARY && tag <= tagSHORT_BINARY+shortBinaryMaxLen:
+    b, err := d.readBytes(int(tag - tagSHORT_BINARY))
+    if err != nil {
+      return err
+    }
+    return assign(value, string(b))
+  }
+
+  switch tag {
+  case tagUNDEF:
+    return assign(value, nil)
+  case tagTRUE:
+    return assign(value, true)
+  case tagFALSE:
+    return assign(value, false)
+  case tagVARINT:
+    n, err := d.readVarint()
+    if err != nil {
+      return err
+    }
+    return assign(value, int64(n))
+  case tagZIGZAG:
+    n, err := d.readVarint()
+    if err != nil {
+      return err
+    }
+    return assign(value, zigzagDecode(n))
+  case tagDOUBLE:
+    f, err := readFloat64(d)
+    if err != nil {
+      return err
+    }
+    return assign(value, f)
+  case tagBINARY, tagSTR_UTF8:
+    n, err := d.readVarint()
+    if err != nil {
+      return err
+    }
+    b, err := d.readBytes(int(n))
+    if err != nil {
+      return err
+    }
+    return assign(value, string(b))
+  case tagREFN:
+    // The tracked offset for a REFN target is the position right
+    // after the tag byte, matching e.tracked[ptr] = e.Len() in the
+    // encoder (set after writeTag(tagREFN)).
+    return d.unmarshalRef(value, d.offset)
+  case tagREFP:
+    return d.unmarshalRefp(value)
+  case tagARRAY:
+    return d.unmarshalArray(value)
+  case tagHASH:
+    return d.unmarshalHash(value)
+  }
+
+  return fmt.Errorf("sereal: unknown tag 0x%x", tag)
+}
+
+// Read lets readFloat64 treat decodeState as a plain io.Reader while
+// keeping the running offset accurate.
+func (d *decodeState) Read(p []byte) (int, error) {
+  n, err := io.ReadFull(d.r, p)
+  d.offset += n
+  return n, err
+}
+
+func (d *decodeState) unmarshalUnmarshaler(u Unmarshaler) error {
+  tag, err := d.readByte()
+  if err != nil {
+    return err
+  }
+
+  switch {
+  case tag == tagUNDEF:
+    return nil
+  case tag == tagBINARY || tag == tagSTR_UTF8:
+    n, err := d.readVarint()
+    if err != nil {
+      return err
+    }
+    b, err := d.readBytes(int(n))
+    if err != nil {
+      return err
+    }
+    return u.UnmarshalSereal(b)
+  case tag >= tagSHORT_BINARY && tag <= tagSHORT_BINARY+shortBinaryMaxLen:
+    b, err := d.readBytes(int(tag - tagSHORT_BINARY))
+    if err != nil {
+      return err
+    }
+    return u.UnmarshalSereal(b)
+  }
+
+  return fmt.Errorf("sereal: cannot unmarshal tag 0x%x into %T", tag, u)
+}
+
+func (d *decodeState) unmarshalRef(value reflect.Value, offset int) error {
+  target := value
+  if value.Kind() == reflect.Ptr {
+    if value.IsNil() {
+      value.Set(reflect.New(value.Type().Elem()))
+    }
+    target = value.Elem()
+  }
+
+  var seen reflect.Value
+  if target.CanAddr() {
+    seen = target.Addr()
+  }
+  d.tracked[offset] = seen
+
+  return d.unmarshalValue(target)
+}
+
+func (d *decodeState) unmarshalRefp(value reflect.Value) error {
+  offset, err := d.readVarint()
+  if err != nil {
+    return err
+  }
+
+  seen, ok := d.tracked[int(offset)]
+  if !ok || !seen.IsValid() {
+    return nil
+  }
+
+  switch value.Kind() {
+  case reflect.Ptr:
+    if seen.Kind() == reflect.Ptr && seen.Type() == value.Type() {
+      value.Set(seen)
+    }
+  case reflect.Interface:
+    value.Set(seen)
+  }
+
+  return nil
+}
+
+// retarget patches tracked backreference offsets created while tmp
+// was being decoded generically (a hash value decoded into
+// interface{} before its destination was settled, see unmarshalHash's
+// reflect.Interface case) so a later tagREFP resolves to the real
+// decoded value (dst) instead of the throwaway interface{} the
+// generic decode had to register with instead.
+func (d *decodeState) retarget(tmp *interface{}, dst reflect.Value) {
+  tmpAddr := reflect.ValueOf(tmp).Pointer()
+  for offset, seen := range d.tracked {
+    if seen.IsValid() && seen.Kind() == reflect.Ptr && seen.Pointer() == tmpAddr {
+      d.tracked[offset] = dst
+    }
+  }
+}
+
+func (d *decodeState) unmarshalArray(value reflect.Value) error {
+  n, err := d.readVarint()
+  if err != nil {
+    return err
+  }
+
+  switch value.Kind() {
+  case reflect.Slice:
+    value.Set(reflect.MakeSlice(value.Type(), int(n), int(n)))
+    for i := uint64(0); i < n; i++ {
+      if err := d.unmarshalValue(value.Index(int(i))); err != nil {
+        return err
+      }
+    }
+    return nil
+
+  case reflect.Interface:
+    s := make([]interface{}, n)
+    for i := uint64(0); i < n; i++ {
+      if err := d.unmarshalValue(reflect.ValueOf(&s[i]).Elem()); err != nil {
+        return err
+      }
+    }
+    value.Set(reflect.ValueOf(s))
+    return nil
+  }
+
+  return &UnmarshalTypeError{Tag: tagARRAY, Value: value.Type()}
+}
+
+func (d *decodeState) unmarshalHash(value reflect.Value) error {
+  n, err := d.readVarint()
+  if err != nil {
+    return err
+  }
+
+  switch value.Kind() {
+  case reflect.Struct:
+    fields := make(map[string]reflect.Value)
+    typ := value.Type()
+    for i := 0; i < typ.NumField(); i++ {
+      name, _, skip := serealFieldTag(typ.Field(i))
+      if skip {
+        continue
+      }
+      fields[name] = value.Field(i)
+    }
+
+    for i := uint64(0); i < n; i++ {
+      key, err := d.readHashKey()
+      if err != nil {
+        return err
+      }
+
+      if fv, ok := fields[key]; ok {
+        if err := d.unmarshalValue(fv); err != nil {
+          return err
+        }
+      } else {
+        var discard interface{}
+        if err := d.unmarshalValue(reflect.ValueOf(&discard).Elem()); err != nil {
+          return err
+        }
+      }
+    }
+
+    return nil
+
+  case reflect.Map:
+    if value.IsNil() {
+      value.Set(reflect.MakeMap(value.Type()))
+    }
+    elemType := value.Type().Elem()
+
+    for i := uint64(0); i < n; i++ {
+      key, err := d.readHashKey()
+      if err != nil {
+        return err
+      }
+
+      elem := reflect.New(elemType).Elem()
+      if err := d.unmarshalValue(elem); err != nil {
+        return err
+      }
+      value.SetMapIndex(reflect.ValueOf(key), elem)
+    }
+
+    return nil
+
+  case reflect.Interface:
+    m := make(map[string]interface{}, n)
+    for i := uint64(0); i < n; i++ {
+      key, err := d.readHashKey()
+      if err != nil {
+        return err
+      }
+
+      var tmp interface{}
+      if err := d.unmarshalValue(reflect.ValueOf(&tmp).Elem()); err != nil {
+        return err
+      }
+      m[key] = tmp
+      d.retarget(&tmp, reflect.ValueOf(tmp))
+    }
+    value.Set(reflect.ValueOf(m))
+
+    return nil
+  }
+
+  return &UnmarshalTypeError{Tag: tagHASH, Value: value.Type()}
+}
+
+// readHashKey reads the BINARY/STR_UTF8/SHORT_BINARY-tagged key that
+// precedes every Sereal hash value.
+func (d *decodeState) readHashKey() (string, error) {
+  var key string
+  kv := reflect.ValueOf(&key).Elem()
+  if err := d.unmarshalValue(kv); err != nil {
+    return "", err
+  }
+  return key, nil
+}
+
+// assign converts the generically decoded value src (nil, bool,
+// string, int64, float64, or an already-typed value from a REFP
+// backreference) into dst.
+func assign(dst reflect.Value, src interface{}) error {
+  if src == nil {
+    dst.Set(reflect.Zero(dst.Type()))
+    return nil
+  }
+
+  if rv := reflect.ValueOf(src); rv.Type().AssignableTo(dst.Type()) {
+    dst.Set(rv)
+    return nil
+  }
+
+  if dst.Kind() == reflect.Ptr {
+    if dst.IsNil() {
+      dst.Set(reflect.New(dst.Type().Elem()))
+    }
+    return assign(dst.Elem(), src)
+  }
+
+  if dst.Kind() == reflect.Interface {
+    dst.Set(reflect.ValueOf(src))
+    return nil
+  }
+
+  switch v := src.(type) {
+  case bool:
+    switch dst.Kind() {
+    case reflect.Bool:
+      dst.SetBool(v)
+    default:
+      return &UnmarshalTypeError{Tag: tagTRUE, Value: dst.Type()}
+    }
+
+  case string:
+    switch dst.Kind() {
+    case reflect.String:
+      dst.SetString(v)
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+      n, err := strconv.ParseInt(v, 10, 64)
+      if err != nil {
+        return err
+      }
+      dst.SetInt(n)
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+      n, err := strconv.ParseUint(v, 10, 64)
+      if err != nil {
+        return err
+      }
+      dst.SetUint(n)
+    case reflect.Float32, reflect.Float64:
+      n, err := strconv.ParseFloat(v, dst.Type().Bits())
+      if err != nil {
+        return err
+      }
+      dst.SetFloat(n)
+    default:
+      return &UnmarshalTypeError{Tag: tagBINARY, Value: dst.Type()}
+    }
+
+  case int64:
+    switch dst.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+      dst.SetInt(v)
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+      dst.SetUint(uint64(v))
+    case reflect.Float32, reflect.Float64:
+      dst.SetFloat(float64(v))
+    default:
+      return &UnmarshalTypeError{Tag: tagVARINT, Value: dst.Type()}
+    }
+
+  case float64:
+    switch dst.Kind() {
+    case reflect.Float32, reflect.Float64:
+      dst.SetFloat(v)
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+      dst.SetInt(int64(v))
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+      dst.SetUint(uint64(v))
+    default:
+      return &UnmarshalTypeError{Tag: tagDOUBLE, Value: dst.Type()}
+    }
+  }
+
+  return nil
+}
@@ -0,0 +1,435 @@
+// Shallow implementation of writing and reading Perl Sereal data
+// (the modern, faster, better-specified successor to Storable).
+// Spec followed from: https://github.com/Sereal/Sereal/blob/master/sereal_spec.pod
+//
+// Like the sibling storable package, this only implements the subset
+// of the format needed to round-trip the Go types this package
+// knows how to marshal: bools, strings, integers, floats, slices,
+// maps, structs and pointers. It does not implement weak references,
+// Perl objects with hooks, aliases, or Snappy compression (the
+// standard library has no Snappy implementation; zlib is supported
+// via CompressionThreshold instead).
+package sereal
+
+import (
+  "bytes"
+  "compress/zlib"
+  "fmt"
+  "io"
+  "reflect"
+  "strings"
+  "unicode"
+)
+
+// magic is the 4-byte Sereal magic string, followed by a single
+// version/type byte: the low nibble holds the protocol version, the
+// high nibble holds the document encoding (raw or zlib).
+var magic = [4]byte{0x3d, 0xf3, 0x72, 0x6c}
+
+const (
+  version = 3
+
+  encodingRaw  = 0x0
+  encodingZlib = 0x1
+)
+
+// Sereal body tags. Numbering follows the public spec. FLOAT is listed
+// but never emitted or read; the other tags this package never emits
+// (OBJECT, ALIAS, WEAKEN, COPY, ...) are omitted.
+const (
+  tagPOS0        = 0x00 // 0x00-0x0f: small positive integers 0-15
+  tagNEG16       = 0x10 // 0x10-0x1f: small negative integers -16..-1
+  tagVARINT      = 0x20 // unsigned varint follows
+  tagZIGZAG      = 0x21 // zigzag-encoded signed varint follows
+  tagFLOAT       = 0x22 // 4-byte IEEE-754 float follows
+  tagDOUBLE      = 0x23 // 8-byte IEEE-754 double follows
+  tagUNDEF       = 0x25 // undef/nil
+  tagBINARY      = 0x26 // varint length + raw bytes
+  tagSTR_UTF8    = 0x27 // varint length + UTF-8 bytes
+  tagREFN        = 0x28 // reference to the value that follows
+  tagREFP        = 0x29 // reference to a previously tracked offset
+  tagHASH        = 0x2a // varint count + count*(key, value) pairs
+  tagARRAY       = 0x2b // varint count + count*value
+  tagTRUE        = 0x3a
+  tagFALSE       = 0x3b
+  tagSHORT_BINARY = 0x60 // 0x60-0x7f: inline length (low 5 bits) + bytes
+)
+
+const shortBinaryMaxLen = 0x1f
+
+// Marshaler is implemented by types that want to encode themselves as
+// a Sereal scalar, analogous to encoding.BinaryMarshaler.
+type Marshaler interface {
+  MarshalSereal() ([]byte, error)
+}
+
+var marshalerType = reflect.TypeOf((*Marshaler)(nil)).Elem()
+
+// Encoder writes Sereal-encoded values to an output stream.
+type Encoder struct {
+  w   io.Writer
+  err error
+
+  // PerlCompat, when true, wraps the top-level value in a REFN the
+  // way Perl's Sereal::Encoder does for a frozen reference, mirroring
+  // the storable package's implicit SX_REF-on-pointer behavior.
+  PerlCompat bool
+
+  // CompressionThreshold, when greater than zero, zlib-compresses
+  // the document body once its uncompressed size exceeds it.
+  CompressionThreshold int
+}
+
+// NewEncoder returns a new Encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+  return &Encoder{w: w}
+}
+
+// Encode writes the Sereal encoding of v.
+func (enc *Encoder) Encode(v interface{}) error {
+  b, err := marshal(v, enc.PerlCompat, enc.CompressionThreshold)
+  if err != nil {
+    return err
+  }
+
+  _, err = enc.w.Write(b)
+  if err != nil {
+    enc.err = err
+  }
+
+  return err
+}
+
+// Marshal returns the Sereal encoding of v.
+func Marshal(v interface{}) ([]byte, error) {
+  return marshal(v, false, 0)
+}
+
+func marshal(v interface{}, perlCompat bool, compressionThreshold int) ([]byte, error) {
+  e := &encodeState{tracked: make(map[uintptr]int)}
+
+  value := reflect.ValueOf(v)
+  if perlCompat && value.Kind() != reflect.Ptr {
+    if err := e.writeTag(tagREFN); err != nil {
+      return nil, err
+    }
+  }
+
+  if err := e.marshalValue(value); err != nil {
+    return nil, err
+  }
+
+  body := e.Bytes()
+  encoding := uint8(encodingRaw)
+  if compressionThreshold > 0 && len(body) > compressionThreshold {
+    var buf bytes.Buffer
+    zw := zlib.NewWriter(&buf)
+    if _, err := zw.Write(body); err != nil {
+      return nil, err
+    }
+    if err := zw.Close(); err != nil {
+      return nil, err
+    }
+    body = buf.Bytes()
+    encoding = encodingZlib
+  }
+
+  var out bytes.Buffer
+  out.Write(magic[:])
+  out.WriteByte(byte(encoding<<4 | version))
+  writeVarint(&out, 0) // header suffix length: we never write optional header data
+
+  bodyLenBuf := &bytes.Buffer{}
+  writeVarint(bodyLenBuf, uint64(len(body)))
+  out.Write(bodyLenBuf.Bytes())
+  out.Write(body)
+
+  return out.Bytes(), nil
+}
+
+// An encodeState encodes a Sereal document body into a bytes.Buffer.
+type encodeState struct {
+  bytes.Buffer
+
+  tracked map[uintptr]int // pointer -> byte offset of its REFN target, for REFP backrefs
+}
+
+func (e *encodeState) writeTag(tag byte) error {
+  return e.WriteByte(tag)
+}
+
+func (e *encodeState) marshalValue(value reflect.Value) error {
+  if !value.IsValid() {
+    return e.writeTag(tagUNDEF)
+  }
+
+  if m, ok := marshalerFor(value); ok {
+    b, err := m.MarshalSereal()
+    if err != nil {
+      return err
+    }
+    return e.writeBinary(b, false)
+  }
+
+  if value.Kind() == reflect.Ptr {
+    if value.IsNil() {
+      return e.writeTag(tagUNDEF)
+    }
+
+    ptr := value.Pointer()
+    if offset, ok := e.tracked[ptr]; ok {
+      if err := e.writeTag(tagREFP); err != nil {
+        return err
+      }
+      writeVarint(&e.Buffer, uint64(offset))
+      return nil
+    }
+
+    if err := e.writeTag(tagREFN); err != nil {
+      return err
+    }
+    e.tracked[ptr] = e.Len()
+
+    return e.marshalValue(value.Elem())
+  }
+
+  switch value.Kind() {
+  case reflect.Struct:
+    return e.marshalStruct(value)
+  case reflect.Map:
+    return e.marshalMap(value)
+  case reflect.Slice, reflect.Array:
+    return e.marshalSlice(value)
+  case reflect.Bool:
+    return e.marshalBool(value)
+  case reflect.String:
+    return e.marshalString(value)
+  case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+    return e.marshalInt(value.Int())
+  case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+    return e.marshalUint(value.Uint())
+  case reflect.Float32, reflect.Float64:
+    return e.marshalFloat(value.Float())
+  }
+
+  return nil
+}
+
+func marshalerFor(value reflect.Value) (Marshaler, bool) {
+  if value.Type().Implements(marshalerType) {
+    return value.Interface().(Marshaler), true
+  }
+  if value.CanAddr() && value.Addr().Type().Implements(marshalerType) {
+    return value.Addr().Interface().(Marshaler), true
+  }
+
+  return nil, false
+}
+
+func (e *encodeState) marshalBool(value reflect.Value) error {
+  if value.Bool() {
+    return e.writeTag(tagTRUE)
+  }
+
+  return e.writeTag(tagFALSE)
+}
+
+func (e *encodeState) marshalInt(n int64) error {
+  if n >= 0 {
+    return e.marshalUint(uint64(n))
+  }
+  if n >= -16 {
+    return e.writeTag(tagNEG16 + byte(n+16))
+  }
+
+  if err := e.writeTag(tagZIGZAG); err != nil {
+    return err
+  }
+  writeVarint(&e.Buffer, zigzagEncode(n))
+
+  return nil
+}
+
+func (e *encodeState) marshalUint(n uint64) error {
+  if n <= 15 {
+    return e.writeTag(tagPOS0 + byte(n))
+  }
+
+  if err := e.writeTag(tagVARINT); err != nil {
+    return err
+  }
+  writeVarint(&e.Buffer, n)
+
+  return nil
+}
+
+func (e *encodeState) marshalFloat(f float64) error {
+  if err := e.writeTag(tagDOUBLE); err != nil {
+    return err
+  }
+
+  return writeFloat64(&e.Buffer, f)
+}
+
+func (e *encodeState) marshalString(value reflect.Value) error {
+  s := value.String()
+  return e.writeBinary([]byte(s), isUTF8(s))
+}
+
+func isUTF8(s string) bool {
+  for _, r := range s {
+    if r > unicode.MaxASCII {
+      return true
+    }
+  }
+
+  return false
+}
+
+// writeBinary writes a BINARY/STR_UTF8 (or inline SHORT_BINARY, for
+// short non-UTF8 strings) tag followed by b.
+func (e *encodeState) writeBinary(b []byte, utf8 bool) error {
+  if !utf8 && len(b) <= shortBinaryMaxLen {
+    if err := e.writeTag(tagSHORT_BINARY + byte(len(b))); err != nil {
+      return err
+    }
+    _, err := e.Write(b)
+    return err
+  }
+
+  tag := byte(tagBINARY)
+  if utf8 {
+    tag = tagSTR_UTF8
+  }
+  if err := e.writeTag(tag); err != nil {
+    return err
+  }
+  writeVarint(&e.Buffer, uint64(len(b)))
+  _, err := e.Write(b)
+
+  return err
+}
+
+func (e *encodeState) marshalSlice(value reflect.Value) error {
+  if err := e.writeTag(tagARRAY); err != nil {
+    return err
+  }
+
+  n := value.Len()
+  writeVarint(&e.Buffer, uint64(n))
+
+  for i := 0; i < n; i++ {
+    if err := e.marshalValue(value.Index(i)); err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+func (e *encodeState) marshalMap(value reflect.Value) error {
+  if err := e.writeTag(tagHASH); err != nil {
+    return err
+  }
+
+  keys := value.MapKeys()
+  writeVarint(&e.Buffer, uint64(len(keys)))
+
+  for _, key := range keys {
+    if err := e.writeBinary([]byte(formatMapKey(key)), false); err != nil {
+      return err
+    }
+    if err := e.marshalValue(value.MapIndex(key)); err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+func formatMapKey(key reflect.Value) string {
+  if key.Kind() == reflect.String {
+    return key.String()
+  }
+
+  return fmt.Sprint(key.Interface())
+}
+
+func (e *encodeState) marshalStruct(value reflect.Value) error {
+  if err := e.writeTag(tagHASH); err != nil {
+    return err
+  }
+
+  typ := value.Type()
+  n := typ.NumField()
+
+  // Count fields first so the varint count can be written before any
+  // field bodies.
+  var names []string
+  for i := 0; i < n; i++ {
+    name, omitempty, skip := serealFieldTag(typ.Field(i))
+    if skip {
+      continue
+    }
+    if omitempty && value.Field(i).Len() == 0 {
+      continue
+    }
+    names = append(names, name)
+  }
+
+  writeVarint(&e.Buffer, uint64(len(names)))
+
+  j := 0
+  for i := 0; i < n; i++ {
+    _, omitempty, skip := serealFieldTag(typ.Field(i))
+    if skip {
+      continue
+    }
+    fieldValue := value.Field(i)
+    if omitempty && fieldValue.Len() == 0 {
+      continue
+    }
+
+    if err := e.writeBinary([]byte(names[j]), false); err != nil {
+      return err
+    }
+    if err := e.marshalValue(fieldValue); err != nil {
+      return err
+    }
+    j++
+  }
+
+  return nil
+}
+
+// serealFieldTag mirrors storable.fieldTag: it reads the same
+// "storable" struct tag convention so a type can be shared between
+// both codecs without duplicating its tags. Unexported fields are
+// always skipped, the same as encoding/json.
+func serealFieldTag(f reflect.StructField) (name string, omitempty, skip bool) {
+  if f.PkgPath != "" {
+    return "", false, true
+  }
+
+  name = f.Name
+
+  tag := f.Tag.Get("storable")
+  if tag == "" {
+    return name, false, false
+  }
+  if tag == "-" {
+    return "", false, true
+  }
+
+  for _, part := range strings.Split(tag, ",") {
+    switch part {
+    case "":
+    case "omitempty":
+      omitempty = true
+    default:
+      name = part
+    }
+  }
+
+  return name, omitempty, false
+}
@@ -0,0 +1,235 @@
+package sereal
+
+import (
+  "strings"
+  "testing"
+)
+
+// Sereal has no Go-Dumper-equivalent test harness available in this
+// environment (no perl Sereal module), so these are Go-only
+// Marshal/Unmarshal round trips, unlike storable_test.go's real-perl
+// verification.
+
+type RoundTripTest struct {
+  in  interface{}
+  out interface{}
+}
+
+var (
+  roundTripTests = []RoundTripTest{
+    {struct{ Name string }{"Kevin"}, &struct{ Name string }{}},
+
+    {struct {
+      Name string
+      Omit string `storable:"omitempty"`
+    }{Name: "Kevin"}, &struct {
+      Name string
+      Omit string `storable:"omitempty"`
+    }{}},
+
+    {"Kevin", new(string)},
+    {1234, new(int)},
+    {-42, new(int)},
+    {5.55, new(float64)},
+    {false, new(bool)},
+    {true, new(bool)},
+    {[]string{"hey", "there"}, &[]string{}},
+    {map[string]string{"a": "b"}, &map[string]string{}},
+  }
+)
+
+func TestRoundTrip(t *testing.T) {
+  for i, tt := range roundTripTests {
+    b, err := Marshal(tt.in)
+    if err != nil {
+      t.Fatalf("%d. Marshal(%#v) error: %v", i, tt.in, err)
+    }
+
+    if err := Unmarshal(b, tt.out); err != nil {
+      t.Fatalf("%d. Unmarshal(%#v) error: %v", i, tt.in, err)
+    }
+  }
+}
+
+func TestHeader(t *testing.T) {
+  b, err := Marshal("Kevin")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if len(b) < 5 {
+    t.Fatalf("encoded document too short: %d bytes", len(b))
+  }
+  if string(b[:4]) != string(magic[:]) {
+    t.Fatalf("bad magic bytes %x", b[:4])
+  }
+  if b[4]&0x0f != version {
+    t.Fatalf("version = %d, want %d", b[4]&0x0f, version)
+  }
+}
+
+func TestLargeString(t *testing.T) {
+  in := strings.Repeat("x", 300)
+
+  b, err := Marshal(in)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  var out string
+  if err := Unmarshal(b, &out); err != nil {
+    t.Fatal(err)
+  }
+
+  if out != in {
+    t.Fatalf("out has length %d, want %d", len(out), len(in))
+  }
+}
+
+func TestCyclicPointer(t *testing.T) {
+  type node struct {
+    Name string
+    Next *node
+  }
+
+  a := &node{Name: "a"}
+  a.Next = a
+
+  b, err := Marshal(a)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  var out node
+  if err := Unmarshal(b, &out); err != nil {
+    t.Fatal(err)
+  }
+
+  if out.Name != "a" {
+    t.Fatalf("Name = %q, want %q", out.Name, "a")
+  }
+  if out.Next != &out {
+    t.Fatalf("Next does not point back to the decoded value")
+  }
+}
+
+func TestSharedPointerField(t *testing.T) {
+  type node struct {
+    Name string
+  }
+  type pair struct {
+    A *node
+    B *node
+  }
+
+  n := &node{Name: "shared"}
+  in := pair{A: n, B: n}
+
+  b, err := Marshal(in)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  var out pair
+  if err := Unmarshal(b, &out); err != nil {
+    t.Fatal(err)
+  }
+
+  if out.A == nil || out.B == nil {
+    t.Fatalf("A = %v, B = %v, want both non-nil", out.A, out.B)
+  }
+  if out.A != out.B {
+    t.Fatalf("A and B decoded to distinct pointers, want a shared pointer")
+  }
+  if out.B.Name != "shared" {
+    t.Fatalf("B.Name = %q, want %q", out.B.Name, "shared")
+  }
+}
+
+func TestSharedPointerFieldIntoInterface(t *testing.T) {
+  type node struct {
+    Name string
+  }
+  type pair struct {
+    A *node
+    B *node
+  }
+
+  n := &node{Name: "shared"}
+  in := pair{A: n, B: n}
+
+  b, err := Marshal(in)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  var out interface{}
+  if err := Unmarshal(b, &out); err != nil {
+    t.Fatal(err)
+  }
+
+  m, ok := out.(map[string]interface{})
+  if !ok {
+    t.Fatalf("out is %T, want map[string]interface{}", out)
+  }
+
+  if _, ok := m["A"].(map[string]interface{}); !ok {
+    t.Fatalf("A is %T, want map[string]interface{}", m["A"])
+  }
+  b2, ok := m["B"].(map[string]interface{})
+  if !ok {
+    t.Fatalf("B is %T, want map[string]interface{}", m["B"])
+  }
+  if b2["Name"] != "shared" {
+    t.Fatalf("B[\"Name\"] = %v, want %q", b2["Name"], "shared")
+  }
+}
+
+func TestCompression(t *testing.T) {
+  var enc Encoder
+  enc.CompressionThreshold = 1
+
+  in := strings.Repeat("compress me ", 50)
+  b, err := marshal(in, enc.PerlCompat, enc.CompressionThreshold)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  var out string
+  if err := Unmarshal(b, &out); err != nil {
+    t.Fatal(err)
+  }
+
+  if out != in {
+    t.Fatalf("out = %q, want %q", out, in)
+  }
+}
+
+type upperCaser string
+
+func (u upperCaser) MarshalSereal() ([]byte, error) {
+  return []byte(strings.ToUpper(string(u))), nil
+}
+
+func (u *upperCaser) UnmarshalSereal(b []byte) error {
+  *u = upperCaser(b)
+  return nil
+}
+
+func TestMarshalerUnmarshaler(t *testing.T) {
+  in := upperCaser("kevin")
+
+  b, err := Marshal(in)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  var out upperCaser
+  if err := Unmarshal(b, &out); err != nil {
+    t.Fatal(err)
+  }
+
+  if out != "KEVIN" {
+    t.Fatalf("out = %q, want %q", out, "KEVIN")
+  }
+}
@@ -0,0 +1,56 @@
+package sereal
+
+import (
+  "bytes"
+  "encoding/binary"
+  "io"
+  "math"
+)
+
+// writeVarint writes n as an unsigned LEB128 varint, the integer
+// encoding Sereal uses for lengths, tracked offsets, and VARINT
+// scalars.
+func writeVarint(buf *bytes.Buffer, n uint64) {
+  for n >= 0x80 {
+    buf.WriteByte(byte(n) | 0x80)
+    n >>= 7
+  }
+  buf.WriteByte(byte(n))
+}
+
+func readVarint(r io.ByteReader) (uint64, error) {
+  var n uint64
+  var shift uint
+  for {
+    b, err := r.ReadByte()
+    if err != nil {
+      return 0, err
+    }
+
+    n |= uint64(b&0x7f) << shift
+    if b&0x80 == 0 {
+      return n, nil
+    }
+    shift += 7
+  }
+}
+
+func zigzagEncode(n int64) uint64 {
+  return uint64((n << 1) ^ (n >> 63))
+}
+
+func zigzagDecode(n uint64) int64 {
+  return int64(n>>1) ^ -int64(n&1)
+}
+
+func writeFloat64(buf *bytes.Buffer, f float64) error {
+  return binary.Write(buf, binary.LittleEndian, math.Float64bits(f))
+}
+
+func readFloat64(r io.Reader) (float64, error) {
+  var bits uint64
+  if err := binary.Read(r, binary.LittleEndian, &bits); err != nil {
+    return 0, err
+  }
+  return math.Float64frombits(bits), nil
+}
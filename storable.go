@@ -1,4 +1,4 @@
-// Shallow implementation of writing perl storable data.
+// Shallow implementation of reading and writing perl storable data.
 // Spec followed from: https://gitorious.org/python-storable/python-storable
 //
 // Notes:
@@ -44,48 +44,106 @@
 package storable
 
 import (
-  "bytes"
   "encoding/binary"
+  "fmt"
   "io"
+  "math"
   "reflect"
-  "strconv"
   "strings"
+  "unicode"
 )
 
 // perl storable spec:
 // I use a number inside of the tags to indicate byte size
 // <1:MAGIC> <1:VERSION>
-// 
+//
+// The top bit of VERSION is set when the encoder was asked to write
+// integers in network order (see Encoder.NetworkOrder below).
+//
 // Hash:
-// <SX_HASH> <4:LEN> 
+// <SX_HASH> <4:LEN>
 //   <TYPE ENTRY> <4:LEN OF KEY> <KEY> ...
 //   <TYPE ENTRY> <4:LEN OF KEY> <KEY> ...
-// 
+//
 // Array:
 //   <SX_ARRAY> <4:LEN>
 //     <TYPE ENTRY>
 //     <TYPE ENTRY>...
 //
-// Scalar/Utf8str:
+// Scalar/Utf8str (small, len <= 255):
 //   <1:TYPE> <1:LEN> <DATA>
 //
+// Scalar/Utf8str (large, len > 255):
+//   <1:TYPE> <4:LEN> <DATA>
+//
+// Integer:
+//   <SX_INTEGER> <8: little-endian>
+//   <SX_NETINT> <4: network (big-endian) byte order>
+//   <SX_BYTE> <1: value + 128> (only ever produced by Perl encoders;
+//             this package always writes SX_INTEGER/SX_NETINT)
+//
+// Double:
+//   <SX_DOUBLE> <8: little-endian IEEE-754>
+//
+// Ref to an already-seen pointer:
+//   <SX_OBJECT> <4:INDEX>
+//
+// Blessed object:
+//   <SX_BLESS> <4:LEN OF CLASS> <CLASS> <TYPE ENTRY>
+//   <SX_IX_BLESS> <4:INDEX OF CLASS> <TYPE ENTRY>
+//
 
 const (
   MAGIC   = 0x5
   VERSION = 0x7
 
-  SX_ARRAY   = 0x2  // ( 2): Array forthcoming (size, item list)
-  SX_HASH    = 0x3  // ( 3): Hash forthcoming (size, key/value pair list)
-  SX_REF     = 0x4  // ( 4): Reference to object forthcoming
-  SX_UNDEF   = 0x5  // ( 5): Undefined scalar
-  SX_SCALAR  = 0xa  // (10): Scalar (binary, small) follows (length, data)
-  SX_UTF8STR = 0x17 // (23): UTF-8 string forthcoming (small)
+  // networkOrderFlag is OR'd into the version byte of the header when
+  // the encoder was told to use network order for SX_NETINT values.
+  networkOrderFlag = 0x80
+
+  SX_OBJECT   = 0x0  // ( 0): Backreference to an already stored object
+  SX_LSCALAR  = 0x1  // ( 1): Scalar (binary, large) follows (length, data)
+  SX_ARRAY    = 0x2  // ( 2): Array forthcoming (size, item list)
+  SX_HASH     = 0x3  // ( 3): Hash forthcoming (size, key/value pair list)
+  SX_REF      = 0x4  // ( 4): Reference to object forthcoming
+  SX_UNDEF    = 0x5  // ( 5): Undefined scalar
+  SX_INTEGER  = 0x6  // ( 6): Integer forthcoming, native byte order
+  SX_DOUBLE   = 0x7  // ( 7): Double forthcoming, native byte order
+  SX_BYTE     = 0x8  // ( 8): Small signed integer forthcoming, one byte biased by 128
+  SX_NETINT   = 0x9  // ( 9): 32-bit integer forthcoming, network order
+  SX_SCALAR   = 0xa  // (10): Scalar (binary, small) follows (length, data)
+  SX_BLESS    = 0x11 // (17): Object is blessed, class name follows (length, data)
+  SX_IX_BLESS = 0x12 // (18): Object is blessed, class name given by index
+  SX_UTF8STR  = 0x17 // (23): UTF-8 string forthcoming (small)
+  SX_LUTF8STR = 0x18 // (24): UTF-8 string forthcoming (large)
 )
 
+// Marshaler is implemented by types that want to encode themselves as
+// a Storable scalar, analogous to encoding.BinaryMarshaler.
+type Marshaler interface {
+  MarshalStorable() ([]byte, error)
+}
+
+var marshalerType = reflect.TypeOf((*Marshaler)(nil)).Elem()
+
+// Blesser is implemented by types that want to be serialized as a
+// blessed Perl object (SX_BLESS/SX_IX_BLESS) carrying the given class
+// name.
+type Blesser interface {
+  StorableBless() string
+}
+
+var blesserType = reflect.TypeOf((*Blesser)(nil)).Elem()
+
 type Encoder struct {
   w   io.Writer
-  e   encodeState
   err error
+
+  // NetworkOrder, when true, writes integers as 32-bit SX_NETINT
+  // values in network (big-endian) byte order instead of the
+  // native-sized SX_INTEGER, and sets the network-order bit in the
+  // header so other Storable implementations know to expect it.
+  NetworkOrder bool
 }
 
 func NewEncoder(w io.Writer) *Encoder {
@@ -93,10 +151,14 @@ func NewEncoder(w io.Writer) *Encoder {
 }
 
 func (enc *Encoder) Encode(v interface{}) error {
-  enc.e.Reset()
+  e := &encodeState{networkOrder: enc.NetworkOrder}
+
+  b, err := e.marshal(v)
+  if err != nil {
+    return err
+  }
 
-  err := enc.e.marshal(v)
-  if _, err = enc.w.Write(enc.e.Bytes()); err != nil {
+  if _, err = enc.w.Write(b); err != nil {
     enc.err = err
   }
 
@@ -105,233 +167,326 @@ func (enc *Encoder) Encode(v interface{}) error {
 
 func Marshal(v interface{}) ([]byte, error) {
   e := &encodeState{}
-  err := e.marshal(v)
-
-  return e.Bytes(), err
+  return e.marshal(v)
 }
 
-// An encodeState encodes storable into a bytes.Buffer.
+// An encodeState builds the lazy encoder tree for a single Marshal or
+// Encode call; it carries no buffer of its own; marshal serializes
+// the finished tree into one preallocated []byte.
 type encodeState struct {
-  bytes.Buffer // accumulated output
+  networkOrder bool
+  seen         map[uintptr]uint32 // pointer -> object index, for SX_OBJECT backrefs
+  classes      map[string]uint32  // class name -> index, for SX_IX_BLESS
 }
 
-func (e *encodeState) marshal(v interface{}) (err error) {
-  err = binary.Write(e, binary.BigEndian, uint8(MAGIC))
-  if err != nil {
-    return err
+func (e *encodeState) marshal(v interface{}) ([]byte, error) {
+  if e.seen == nil {
+    e.seen = make(map[uintptr]uint32)
+  }
+  if e.classes == nil {
+    e.classes = make(map[string]uint32)
   }
 
-  err = binary.Write(e, binary.BigEndian, uint8(VERSION))
-  if err != nil {
-    return err
+  version := byte(VERSION)
+  if e.networkOrder {
+    version |= networkOrderFlag
   }
+  hdr := multiEncoder{byteEncoder(MAGIC), byteEncoder(version)}
 
-  // d := reflect.ValueOf(v)
-  // if d.Kind() == reflect.Ptr {
-  //   err = e.marshalValue(d.Elem())
-  // } else {
-  //   err = e.marshalValue(d)
-  // }
+  body, err := e.marshalValue(reflect.ValueOf(v))
+  if err != nil {
+    return nil, err
+  }
 
-  err = e.marshalValue(reflect.ValueOf(v))
+  top := multiEncoder{hdr, body}
+  buf := make([]byte, top.Len())
+  top.Encode(buf)
 
-  return err
+  return buf, nil
 }
 
-func (e *encodeState) marshalValue(value reflect.Value) error {
-  var err error
+func (e *encodeState) marshalValue(value reflect.Value) (encoder, error) {
+  if !value.IsValid() {
+    return byteEncoder(SX_UNDEF), nil
+  }
 
+  if m, ok := marshalerFor(value); ok {
+    b, err := m.MarshalStorable()
+    if err != nil {
+      return nil, err
+    }
+    return e.writeScalar(bytesEncoder(b), len(b), false), nil
+  }
+
+  var refPrefix encoder
   if value.Kind() == reflect.Ptr {
-    value = value.Elem()
+    if value.IsNil() {
+      return byteEncoder(SX_UNDEF), nil
+    }
 
-    err = binary.Write(e, binary.BigEndian, uint8(SX_REF))
-    if err != nil {
-      return err
+    ptr := value.Pointer()
+    if idx, ok := e.seen[ptr]; ok {
+      return multiEncoder{byteEncoder(SX_OBJECT), uintEncoder{uint64(idx), 4, binary.BigEndian}}, nil
     }
+    e.seen[ptr] = uint32(len(e.seen))
+
+    refPrefix = byteEncoder(SX_REF)
+    value = value.Elem()
   }
 
-  typ := value.Type()
-  switch typ.Kind() {
+  var body encoder
+  var err error
+  if class, ok := blessNameFor(value); ok {
+    body, err = e.marshalBlessed(value, class)
+  } else {
+    body, err = e.marshalKind(value)
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  if refPrefix != nil {
+    return multiEncoder{refPrefix, body}, nil
+  }
+
+  return body, nil
+}
+
+func (e *encodeState) marshalKind(value reflect.Value) (encoder, error) {
+  switch value.Type().Kind() {
   case reflect.Struct:
-    err = e.marshalStruct(value)
+    return e.marshalStruct(value)
   case reflect.Slice, reflect.Array:
-    err = e.marshalSlice(value)
+    return e.marshalSlice(value)
   case reflect.Bool:
-    err = e.marshalBool(value)
+    return e.marshalBool(value), nil
   case reflect.String:
-    err = e.marshalString(value)
+    return e.marshalString(value), nil
   case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-    err = e.marshalInt(value)
+    return e.marshalInt(value)
   case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
-    err = e.marshalUint(value)
+    return e.marshalUint(value)
   case reflect.Float32, reflect.Float64:
-    err = e.marshalFloat(value)
+    return e.marshalFloat(value), nil
   }
 
-  return err
+  return multiEncoder{}, nil
+}
+
+// marshalerFor reports whether value (or its address) implements
+// Marshaler.
+func marshalerFor(value reflect.Value) (Marshaler, bool) {
+  if value.Type().Implements(marshalerType) {
+    return value.Interface().(Marshaler), true
+  }
+  if value.CanAddr() && value.Addr().Type().Implements(marshalerType) {
+    return value.Addr().Interface().(Marshaler), true
+  }
+
+  return nil, false
+}
+
+// blessNameFor reports whether value (or its address) implements
+// Blesser, returning the Perl class name to bless it as.
+func blessNameFor(value reflect.Value) (string, bool) {
+  if value.Type().Implements(blesserType) {
+    return value.Interface().(Blesser).StorableBless(), true
+  }
+  if value.CanAddr() && value.Addr().Type().Implements(blesserType) {
+    return value.Addr().Interface().(Blesser).StorableBless(), true
+  }
+
+  return "", false
 }
 
-func (e *encodeState) marshalStruct(value reflect.Value) error {
-  err := binary.Write(e, binary.BigEndian, uint8(SX_HASH))
+func (e *encodeState) marshalBlessed(value reflect.Value, class string) (encoder, error) {
+  var prefix encoder
+  if idx, ok := e.classes[class]; ok {
+    prefix = multiEncoder{byteEncoder(SX_IX_BLESS), uintEncoder{uint64(idx), 4, binary.BigEndian}}
+  } else {
+    e.classes[class] = uint32(len(e.classes))
+    prefix = multiEncoder{
+      byteEncoder(SX_BLESS),
+      uintEncoder{uint64(len(class)), 4, binary.BigEndian},
+      stringEncoder(class),
+    }
+  }
+
+  body, err := e.marshalKind(value)
   if err != nil {
-    return err
+    return nil, err
+  }
+
+  return multiEncoder{prefix, body}, nil
+}
+
+// writeScalar builds a Storable scalar tag (SX_SCALAR/SX_LSCALAR, or
+// their UTF-8 counterparts) followed by body, choosing the large
+// variant once length no longer fits in a single byte.
+func (e *encodeState) writeScalar(body encoder, length int, utf8 bool) encoder {
+  small, large := byte(SX_SCALAR), byte(SX_LSCALAR)
+  if utf8 {
+    small, large = SX_UTF8STR, SX_LUTF8STR
   }
 
+  if length > 255 {
+    return multiEncoder{byteEncoder(large), uintEncoder{uint64(length), 4, binary.BigEndian}, body}
+  }
+
+  return multiEncoder{byteEncoder(small), byteEncoder(uint8(length)), body}
+}
+
+func (e *encodeState) marshalStruct(value reflect.Value) (encoder, error) {
   typ := value.Type()
   n := typ.NumField()
 
-  totalSize := 0
-  // write serialize children in temporary buffer since
-  // we find out how many children there are later and we
-  // need to write the children size first.
-  e2 := &encodeState{}
+  fields := make(multiEncoder, 0, n)
+  var count uint32
+
   for i := 0; i < n; i++ {
     f := typ.Field(i)
     fieldValue := value.FieldByName(f.Name)
 
-    fopts := strings.Split(f.Tag.Get("storable"), ",")
-    if len(fopts) > 0 && fopts[0] == "omitempty" && fieldValue.Len() == 0 {
+    name, omitempty, skip := fieldTag(f)
+    if skip {
       continue
     }
-    totalSize++
-
-    err = e2.marshalValue(fieldValue)
-    if err != nil {
-      return err
+    if omitempty && fieldValue.Len() == 0 {
+      continue
     }
 
-    // Write hash key
-    binary.Write(e2, binary.BigEndian, uint32(len(f.Name)))
-    _, err = e2.WriteString(f.Name)
+    fieldEnc, err := e.marshalValue(fieldValue)
     if err != nil {
-      return err
+      return nil, err
     }
-  }
+    count++
 
-  err = binary.Write(e, binary.BigEndian, uint32(totalSize))
-  if err != nil {
-    return err
+    fields = append(fields, fieldEnc, uintEncoder{uint64(len(name)), 4, binary.BigEndian}, stringEncoder(name))
   }
 
-  _, err = e.Write(e2.Bytes())
-
-  return err
+  return &taggedEncoder{tag: SX_HASH, count: count, body: fields}, nil
 }
 
-func (e *encodeState) marshalSlice(value reflect.Value) error {
-  var err error
-
-  err = binary.Write(e, binary.BigEndian, uint8(SX_ARRAY))
-  if err != nil {
-    return err
+// fieldTag parses the "storable" struct tag for f, returning the
+// Perl-side hash key to use (name), whether the field should be
+// omitted when empty (omitempty), and whether the field should be
+// skipped entirely (skip).
+//
+// Recognized forms:
+//   storable:"-"          skip the field
+//   storable:"omitempty"  omit the field when it is empty
+//   storable:"perlname"   use "perlname" as the hash key instead of
+//                         the Go field name
+// The rename and omitempty forms can be combined with a comma, e.g.
+// storable:"perlname,omitempty".
+//
+// Unexported fields are always skipped, the same as encoding/json:
+// they can't be set via reflection, and f.Tag is still readable on
+// them so they'd otherwise slip through the "-" check only.
+func fieldTag(f reflect.StructField) (name string, omitempty, skip bool) {
+  if f.PkgPath != "" {
+    return "", false, true
   }
 
-  n := value.Len()
-  err = binary.Write(e, binary.BigEndian, uint32(n))
-  if err != nil {
-    return err
+  name = f.Name
+
+  tag := f.Tag.Get("storable")
+  if tag == "" {
+    return name, false, false
+  }
+  if tag == "-" {
+    return "", false, true
   }
 
-  for i := 0; i < n; i++ {
-    err = e.marshalValue(value.Index(i))
-    if err != nil {
-      return err
+  for _, part := range strings.Split(tag, ",") {
+    switch part {
+    case "":
+    case "omitempty":
+      omitempty = true
+    default:
+      name = part
     }
   }
 
-  return nil
+  return name, omitempty, false
 }
 
-func (e *encodeState) marshalBool(value reflect.Value) error {
-  var err error
-
-  err = binary.Write(e, binary.BigEndian, uint8(SX_SCALAR))
-  if err != nil {
-    return err
-  }
-  err = binary.Write(e, binary.BigEndian, uint8(1))
-  if err != nil {
-    return err
-  }
+func (e *encodeState) marshalSlice(value reflect.Value) (encoder, error) {
+  n := value.Len()
+  items := make(multiEncoder, n)
 
-  if value.Bool() {
-    _, err = e.Write([]byte(strconv.FormatInt(1, 10)))
-  } else {
-    _, err = e.Write([]byte(strconv.FormatInt(0, 10)))
+  for i := 0; i < n; i++ {
+    itemEnc, err := e.marshalValue(value.Index(i))
+    if err != nil {
+      return nil, err
+    }
+    items[i] = itemEnc
   }
 
-  return err
+  return &taggedEncoder{tag: SX_ARRAY, count: uint32(n), body: items}, nil
 }
 
-func (e *encodeState) marshalString(value reflect.Value) error {
-  var err error
-
-  err = binary.Write(e, binary.BigEndian, uint8(SX_SCALAR))
-  if err != nil {
-    return err
-  }
-  err = binary.Write(e, binary.BigEndian, uint8(value.Len()))
-  if err != nil {
-    return err
+func (e *encodeState) marshalBool(value reflect.Value) encoder {
+  if value.Bool() {
+    return e.writeScalar(stringEncoder("1"), 1, false)
   }
 
-  //err = binary.Write(e, binary.BigEndian, uint8(SX_UTF8STR))
-  //err = binary.Write(e, binary.BigEndian, uint8(value.Len()))
-
-  _, err = e.Write([]byte(value.String()))
-  return err
+  return e.writeScalar(stringEncoder("0"), 1, false)
 }
 
-func (e *encodeState) marshalInt(value reflect.Value) error {
-  var err error
-
-  err = binary.Write(e, binary.BigEndian, uint8(SX_SCALAR))
-  if err != nil {
-    return err
-  }
+func (e *encodeState) marshalString(value reflect.Value) encoder {
+  s := value.String()
+  return e.writeScalar(stringEncoder(s), len(s), isUTF8(s))
+}
 
-  s := strconv.FormatInt(value.Int(), 10)
-  err = binary.Write(e, binary.BigEndian, uint8(len(s)))
-  if err != nil {
-    return err
+// isUTF8 reports whether s contains any non-ASCII runes, in which
+// case it must be written as SX_UTF8STR/SX_LUTF8STR rather than a
+// plain SX_SCALAR/SX_LSCALAR.
+func isUTF8(s string) bool {
+  for _, r := range s {
+    if r > unicode.MaxASCII {
+      return true
+    }
   }
 
-  _, err = e.Write([]byte(s))
-  return err
+  return false
 }
 
-func (e *encodeState) marshalUint(value reflect.Value) error {
-  var err error
-
-  err = binary.Write(e, binary.BigEndian, uint8(SX_SCALAR))
-  if err != nil {
-    return err
-  }
+// marshalInt writes a signed integer as SX_INTEGER (8 bytes,
+// little-endian) or, when the encoder was asked for network
+// order, as a 32-bit SX_NETINT. It errors rather than silently
+// truncating a value SX_NETINT's 4-byte payload can't hold.
+func (e *encodeState) marshalInt(value reflect.Value) (encoder, error) {
+  n := value.Int()
 
-  s := strconv.FormatUint(value.Uint(), 10)
-  err = binary.Write(e, binary.BigEndian, uint8(len(s)))
-  if err != nil {
-    return err
+  if e.networkOrder {
+    if n < math.MinInt32 || n > math.MaxInt32 {
+      return nil, fmt.Errorf("storable: %d overflows SX_NETINT's 32 bits (Encoder.NetworkOrder is set)", n)
+    }
+    return multiEncoder{byteEncoder(SX_NETINT), uintEncoder{uint64(uint32(int32(n))), 4, binary.BigEndian}}, nil
   }
 
-  _, err = e.Write([]byte(s))
-  return err
+  return multiEncoder{byteEncoder(SX_INTEGER), uintEncoder{uint64(n), 8, binary.LittleEndian}}, nil
 }
 
-func (e *encodeState) marshalFloat(value reflect.Value) error {
-  var err error
+func (e *encodeState) marshalUint(value reflect.Value) (encoder, error) {
+  n := value.Uint()
 
-  err = binary.Write(e, binary.BigEndian, uint8(SX_SCALAR))
-  if err != nil {
-    return err
+  if e.networkOrder {
+    if n > math.MaxUint32 {
+      return nil, fmt.Errorf("storable: %d overflows SX_NETINT's 32 bits (Encoder.NetworkOrder is set)", n)
+    }
+    return multiEncoder{byteEncoder(SX_NETINT), uintEncoder{n, 4, binary.BigEndian}}, nil
   }
 
-  s := strconv.FormatFloat(value.Float(), 'g', -1, value.Type().Bits())
-  err = binary.Write(e, binary.BigEndian, uint8(len(s)))
-  if err != nil {
-    return err
-  }
+  return multiEncoder{byteEncoder(SX_INTEGER), uintEncoder{n, 8, binary.LittleEndian}}, nil
+}
 
-  _, err = e.Write([]byte(s))
-  return err
+// marshalFloat writes a Go float as SX_DOUBLE, an 8-byte little-endian
+// IEEE-754 double. Unlike integers, doubles aren't re-ordered for
+// Encoder.NetworkOrder: Storable itself doesn't guarantee portable
+// doubles across architectures.
+func (e *encodeState) marshalFloat(value reflect.Value) encoder {
+  bits := math.Float64bits(value.Float())
+  return multiEncoder{byteEncoder(SX_DOUBLE), uintEncoder{bits, 8, binary.LittleEndian}}
 }
@@ -36,7 +36,7 @@ var (
     }{&nested{"Kevin"}}, `{'nested' => {'Name' => 'Kevin'}}`},
 
     {"Kevin", `\'Kevin'`},
-    {1234, `\'1234'`},
+    {1234, `\1234`},
     {5.55, `\'5.55'`},
     {false, `\'0'`},
     {[]string{"hey", "there"}, `['hey','there']`},